@@ -0,0 +1,135 @@
+// Package v1 contains the Canary custom resource: the declarative,
+// first-class representation of a canary rollout that the controller in
+// the devops-tool-htmx package reconciles against.
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group the Canary CRD is registered under.
+const GroupName = "devops-tool-htmx.local"
+
+// GroupVersion identifies the devops-tool-htmx.local/v1 API.
+var GroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
+
+// Resource returns a GroupResource for the given resource name in this API
+// group, e.g. Resource("canaries").
+func Resource(resource string) schema.GroupResource {
+	return GroupVersion.WithResource(resource).GroupResource()
+}
+
+// CanaryMetricSpec mirrors a single metric check from CanaryAnalysis, kept
+// as its own type here since a Canary resource should be self-describing
+// without importing the main package.
+type CanaryMetricSpec struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// CanaryAnalysisSpec is the progressive-delivery strategy for a Canary, as
+// described in the spec rather than passed in over the create_canary API.
+type CanaryAnalysisSpec struct {
+	PrometheusURL string             `json:"prometheusUrl"`
+	Interval      string             `json:"interval"`
+	Threshold     int                `json:"threshold"`
+	MaxWeight     int32              `json:"maxWeight"`
+	StepWeight    int32              `json:"stepWeight"`
+	Iterations    int                `json:"iterations"`
+	Metrics       []CanaryMetricSpec `json:"metrics,omitempty"`
+}
+
+// CanarySpec is the desired state of a Canary: which Deployment it targets,
+// what to roll out, and (optionally) how to analyze it.
+type CanarySpec struct {
+	TargetDeployment string              `json:"targetDeployment"`
+	Image            string              `json:"image"`
+	Replicas         int32               `json:"replicas"`
+	Analysis         *CanaryAnalysisSpec `json:"analysis,omitempty"`
+}
+
+// CanaryPhase is the high-level lifecycle state of a Canary, mirrored from
+// the owned Deployment's analysis annotations.
+type CanaryPhase string
+
+const (
+	CanaryPhaseProgressing CanaryPhase = "Progressing"
+	CanaryPhasePromoting   CanaryPhase = "Promoting"
+	CanaryPhaseSucceeded   CanaryPhase = "Succeeded"
+	CanaryPhaseFailed      CanaryPhase = "Failed"
+)
+
+// CanaryCondition is a single observation about a Canary's rollout,
+// following the standard Kubernetes condition shape.
+type CanaryCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// CanaryStatus is the observed state of a Canary, kept in sync by the
+// controller from the owned Deployment's analysis annotations.
+type CanaryStatus struct {
+	Phase              CanaryPhase       `json:"phase,omitempty"`
+	Weight             int32             `json:"weight,omitempty"`
+	LastTransitionTime metav1.Time       `json:"lastTransitionTime,omitempty"`
+	Conditions         []CanaryCondition `json:"conditions,omitempty"`
+}
+
+// Canary is a first-class, declarative canary rollout: `kubectl apply -f`
+// (or the devops-tool-htmx create_canary handler) creates one, and the
+// controller owns everything downstream of it.
+type Canary struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CanarySpec   `json:"spec,omitempty"`
+	Status CanaryStatus `json:"status,omitempty"`
+}
+
+// CanaryList is a list of Canary resources.
+type CanaryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Canary `json:"items"`
+}
+
+// DeepCopyObject implements runtime.Object so Canary can flow through the
+// typed and dynamic client machinery alike.
+func (c *Canary) DeepCopyObject() runtime.Object {
+	if c == nil {
+		return nil
+	}
+	out := new(Canary)
+	*out = *c
+	out.ObjectMeta = *c.ObjectMeta.DeepCopy()
+	if c.Spec.Analysis != nil {
+		analysis := *c.Spec.Analysis
+		analysis.Metrics = append([]CanaryMetricSpec(nil), c.Spec.Analysis.Metrics...)
+		out.Spec.Analysis = &analysis
+	}
+	out.Status.Conditions = append([]CanaryCondition(nil), c.Status.Conditions...)
+	return out
+}
+
+// DeepCopyObject implements runtime.Object for CanaryList.
+func (l *CanaryList) DeepCopyObject() runtime.Object {
+	if l == nil {
+		return nil
+	}
+	out := new(CanaryList)
+	out.TypeMeta = l.TypeMeta
+	out.ListMeta = l.ListMeta
+	out.Items = make([]Canary, len(l.Items))
+	for i := range l.Items {
+		out.Items[i] = *l.Items[i].DeepCopyObject().(*Canary)
+	}
+	return out
+}
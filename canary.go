@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// Annotations used to persist canary analysis state on the canary
+// Deployment itself, so the analysis loop can resume after a restart.
+const (
+	canaryAnnotationPrefix = "devops-tool-htmx.local/"
+	annCanaryAnalysis      = canaryAnnotationPrefix + "analysis"
+	annCanaryPhase         = canaryAnnotationPrefix + "phase"
+	annCanaryWeight        = canaryAnnotationPrefix + "weight"
+	annCanarySuccessful    = canaryAnnotationPrefix + "successful-checks"
+	annCanaryFailed        = canaryAnnotationPrefix + "failed-checks"
+	annCanaryMaxWeightHits = canaryAnnotationPrefix + "max-weight-checks"
+)
+
+type CanaryPhase string
+
+const (
+	CanaryProgressing CanaryPhase = "Progressing"
+	CanaryPromoting   CanaryPhase = "Promoting"
+	CanarySucceeded   CanaryPhase = "Succeeded"
+	CanaryFailed      CanaryPhase = "Failed"
+)
+
+type CanaryMetric struct {
+	Name  string   `json:"name"`
+	Query string   `json:"query"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// CanaryAnalysis describes the progressive delivery strategy for a canary:
+// how often to check it, how many consecutive failures to tolerate before
+// rolling back, how far traffic should ramp, how many consecutive
+// successful checks at MaxWeight are required before promoting, and which
+// Prometheus metrics gate each step.
+type CanaryAnalysis struct {
+	PrometheusURL string         `json:"prometheusUrl"`
+	Interval      string         `json:"interval"`
+	Threshold     int            `json:"threshold"`
+	MaxWeight     int32          `json:"maxWeight"`
+	StepWeight    int32          `json:"stepWeight"`
+	Iterations    int            `json:"iterations"`
+	Metrics       []CanaryMetric `json:"metrics"`
+}
+
+// CanaryStatus is the analysis state exposed to callers (status endpoint,
+// AppStateResponse) for a single canary Deployment.
+type CanaryStatus struct {
+	CanaryName       string      `json:"canaryName"`
+	Phase            CanaryPhase `json:"phase"`
+	Weight           int32       `json:"weight"`
+	SuccessfulChecks int         `json:"successfulChecks"`
+	FailedChecks     int         `json:"failedChecks"`
+	MaxWeightChecks  int         `json:"maxWeightChecks"`
+}
+
+// canaryRunKey identifies one in-flight (or resumable) canary analysis
+// across clusters and namespaces, since canary deployment names are only
+// unique within a single cluster/namespace pair.
+type canaryRunKey struct {
+	cluster    string
+	namespace  string
+	canaryName string
+}
+
+// canaryRuns tracks the cancel func for each in-flight analysis goroutine,
+// so /abort and re-creation can stop a previous run before starting another.
+var canaryRuns = struct {
+	mu      sync.Mutex
+	cancels map[canaryRunKey]context.CancelFunc
+}{cancels: map[canaryRunKey]context.CancelFunc{}}
+
+func startCanaryAnalysis(client *ClusterClient, cluster, namespace, appName, canaryName string, analysis CanaryAnalysis) {
+	key := canaryRunKey{cluster: cluster, namespace: namespace, canaryName: canaryName}
+	stopCanaryAnalysis(cluster, namespace, canaryName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canaryRuns.mu.Lock()
+	canaryRuns.cancels[key] = cancel
+	canaryRuns.mu.Unlock()
+
+	go runCanaryAnalysis(ctx, client, cluster, namespace, appName, canaryName, analysis)
+}
+
+func stopCanaryAnalysis(cluster, namespace, canaryName string) {
+	key := canaryRunKey{cluster: cluster, namespace: namespace, canaryName: canaryName}
+	canaryRuns.mu.Lock()
+	defer canaryRuns.mu.Unlock()
+	if cancel, ok := canaryRuns.cancels[key]; ok {
+		cancel()
+		delete(canaryRuns.cancels, key)
+	}
+}
+
+// resumeCanaryAnalyses restarts the analysis loop for every canary
+// Deployment, in every watched namespace of every registered cluster, that
+// still carries a persisted, non-terminal phase, so an analysis survives a
+// restart of the tool itself.
+func resumeCanaryAnalyses(ctx context.Context, registry *ClusterRegistry) {
+	for _, cluster := range registry.Clusters() {
+		client, err := registry.Get(cluster)
+		if err != nil {
+			continue
+		}
+		namespaces, err := registry.Namespaces(ctx, cluster)
+		if err != nil {
+			log.Warnf("resumeCanaryAnalyses: listing namespaces for cluster %s: %v", cluster, err)
+			continue
+		}
+		for _, namespace := range namespaces {
+			resumeCanaryAnalysesInNamespace(ctx, client, cluster, namespace)
+		}
+	}
+}
+
+func resumeCanaryAnalysesInNamespace(ctx context.Context, client *ClusterClient, cluster, namespace string) {
+	deployments, err := client.Clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "track=canary",
+	})
+	if err != nil {
+		log.Warnf("resumeCanaryAnalyses: listing canary deployments in %s/%s: %v", cluster, namespace, err)
+		return
+	}
+	for _, d := range deployments.Items {
+		raw, ok := d.Annotations[annCanaryAnalysis]
+		if !ok {
+			continue
+		}
+		phase := CanaryPhase(d.Annotations[annCanaryPhase])
+		if phase == CanarySucceeded || phase == CanaryFailed {
+			continue
+		}
+		var analysis CanaryAnalysis
+		if err := json.Unmarshal([]byte(raw), &analysis); err != nil {
+			log.Warnf("resumeCanaryAnalyses: %s/%s/%s has unparsable analysis annotation: %v", cluster, namespace, d.Name, err)
+			continue
+		}
+		appName := d.GetLabels()["app"]
+		if appName == "" {
+			continue
+		}
+		log.Infof("resuming canary analysis for %s/%s/%s (app %s)", cluster, namespace, d.Name, appName)
+		startCanaryAnalysis(client, cluster, namespace, appName, d.Name, analysis)
+	}
+}
+
+func runCanaryAnalysis(ctx context.Context, client *ClusterClient, cluster, namespace, appName, canaryName string, analysis CanaryAnalysis) {
+	interval, err := time.ParseDuration(analysis.Interval)
+	if err != nil {
+		interval = 30 * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !tickCanaryAnalysis(ctx, client, cluster, namespace, appName, canaryName, analysis) {
+				return
+			}
+		}
+	}
+}
+
+// tickCanaryAnalysis runs a single analysis check and returns false once the
+// canary has reached a terminal phase and the loop should stop.
+func tickCanaryAnalysis(ctx context.Context, client *ClusterClient, cluster, namespace, appName, canaryName string, analysis CanaryAnalysis) bool {
+	canary, err := client.Clientset.AppsV1().Deployments(namespace).Get(ctx, canaryName, metav1.GetOptions{})
+	if err != nil {
+		log.Warnf("canary analysis %s/%s/%s: deployment disappeared, stopping: %v", cluster, namespace, canaryName, err)
+		return false
+	}
+
+	weight, _ := strconv.ParseInt(canary.Annotations[annCanaryWeight], 10, 32)
+	successful, _ := strconv.Atoi(canary.Annotations[annCanarySuccessful])
+	failed, _ := strconv.Atoi(canary.Annotations[annCanaryFailed])
+	maxWeightChecks, _ := strconv.Atoi(canary.Annotations[annCanaryMaxWeightHits])
+
+	if checkCanaryMetrics(ctx, analysis) {
+		successful++
+		failed = 0
+		if int32(weight) < analysis.MaxWeight {
+			weight += int64(analysis.StepWeight)
+			if weight > int64(analysis.MaxWeight) {
+				weight = int64(analysis.MaxWeight)
+			}
+		}
+		if int32(weight) >= analysis.MaxWeight {
+			maxWeightChecks++
+		} else {
+			maxWeightChecks = 0
+		}
+	} else {
+		failed++
+		maxWeightChecks = 0
+	}
+
+	if client.Router != nil {
+		if err := client.Router.SetWeight(ctx, namespace, appName, canaryName, int32(weight)); err != nil {
+			log.Warnf("canary analysis %s/%s/%s: setting weight to %d: %v", cluster, namespace, canaryName, weight, err)
+		}
+	}
+
+	// Threshold tolerates that many consecutive failed checks; the next one
+	// rolls back. Promotion requires Iterations consecutive successful
+	// checks once weight has reached MaxWeight - a dedicated counter, since
+	// by the time MaxWeight is reached, successful (cumulative over the whole
+	// run; a failed check does not reset it) is already >= MaxWeight/StepWeight and would otherwise
+	// promote on the very first check at MaxWeight.
+	phase := CanaryProgressing
+	switch {
+	case failed > analysis.Threshold:
+		phase = CanaryFailed
+	case int32(weight) >= analysis.MaxWeight && maxWeightChecks >= analysis.Iterations:
+		phase = CanaryPromoting
+	}
+
+	if err := patchCanaryState(ctx, client, namespace, canaryName, phase, int32(weight), successful, failed, maxWeightChecks); err != nil {
+		log.Warnf("canary analysis %s/%s/%s: failed to persist state: %v", cluster, namespace, canaryName, err)
+	}
+
+	switch phase {
+	case CanaryFailed:
+		if err := rollbackCanary(ctx, client, namespace, appName, canaryName); err != nil {
+			log.Warnf("canary analysis %s/%s/%s: rollback failed: %v", cluster, namespace, canaryName, err)
+		}
+		return false
+	case CanaryPromoting:
+		if err := promoteCanary(ctx, client, namespace, appName, canaryName); err != nil {
+			log.Warnf("canary analysis %s/%s/%s: promotion failed: %v", cluster, namespace, canaryName, err)
+		}
+		return false
+	}
+
+	return true
+}
+
+func checkCanaryMetrics(ctx context.Context, analysis CanaryAnalysis) bool {
+	if len(analysis.Metrics) == 0 {
+		log.Warnf("canary analysis: no metrics configured, treating check as failed rather than auto-promoting")
+		return false
+	}
+	for _, metric := range analysis.Metrics {
+		value, err := queryPrometheusMetric(ctx, analysis.PrometheusURL, metric.Query)
+		if err != nil {
+			log.Warnf("canary analysis: querying metric %s: %v", metric.Name, err)
+			return false
+		}
+		if metric.Min != nil && value < *metric.Min {
+			return false
+		}
+		if metric.Max != nil && value > *metric.Max {
+			return false
+		}
+	}
+	return true
+}
+
+type prometheusResponse struct {
+	Data struct {
+		Result []struct {
+			Value []interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusQueryTimeout bounds a single metric query so a slow or
+// black-holed Prometheus endpoint can't hang tickCanaryAnalysis forever -
+// the request is also tied to the analysis ctx, so /abort can cancel it
+// in-flight.
+const prometheusQueryTimeout = 10 * time.Second
+
+var prometheusHTTPClient = &http.Client{Timeout: prometheusQueryTimeout}
+
+func queryPrometheusMetric(ctx context.Context, endpoint, query string) (float64, error) {
+	reqURL := fmt.Sprintf("%s/api/v1/query?query=%s", endpoint, url.QueryEscape(query))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := prometheusHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var parsed prometheusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return 0, err
+	}
+	if len(parsed.Data.Result) == 0 || len(parsed.Data.Result[0].Value) != 2 {
+		return 0, fmt.Errorf("no samples returned for query %q", query)
+	}
+	raw, ok := parsed.Data.Result[0].Value[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected value type for query %q", query)
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+func patchCanaryState(ctx context.Context, client *ClusterClient, namespace, canaryName string, phase CanaryPhase, weight int32, successful, failed, maxWeightChecks int) error {
+	patch := []jsonPatchOp{
+		{Op: "add", Path: "/metadata/annotations/" + jsonPatchEscape(annCanaryPhase), Value: string(phase)},
+		{Op: "add", Path: "/metadata/annotations/" + jsonPatchEscape(annCanaryWeight), Value: strconv.Itoa(int(weight))},
+		{Op: "add", Path: "/metadata/annotations/" + jsonPatchEscape(annCanarySuccessful), Value: strconv.Itoa(successful)},
+		{Op: "add", Path: "/metadata/annotations/" + jsonPatchEscape(annCanaryFailed), Value: strconv.Itoa(failed)},
+		{Op: "add", Path: "/metadata/annotations/" + jsonPatchEscape(annCanaryMaxWeightHits), Value: strconv.Itoa(maxWeightChecks)},
+	}
+	payload, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Clientset.AppsV1().Deployments(namespace).Patch(ctx, canaryName, types.JSONPatchType, payload, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	if err := syncCanaryStatus(ctx, client, namespace, canaryName, phase, weight); err != nil {
+		log.Warnf("canary analysis %s/%s: syncing canary resource status: %v", namespace, canaryName, err)
+	}
+	return nil
+}
+
+// jsonPatchEscape escapes "~" and "/" per RFC 6901 so an annotation key
+// containing a slash (e.g. "devops-tool-htmx.local/phase") can be used as a
+// JSON Patch path segment.
+func jsonPatchEscape(s string) string {
+	s = strings.ReplaceAll(s, "~", "~0")
+	return strings.ReplaceAll(s, "/", "~1")
+}
+
+func promoteCanary(ctx context.Context, client *ClusterClient, namespace, appName, canaryName string) error {
+	canary, err := client.Clientset.AppsV1().Deployments(namespace).Get(ctx, canaryName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	image := canary.Spec.Template.Spec.Containers[0].Image
+
+	patch := []jsonPatchOp{
+		{Op: "replace", Path: "/spec/template/spec/containers/0/image", Value: image},
+	}
+	payload, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	if _, err := client.Clientset.AppsV1().Deployments(namespace).Patch(ctx, appName, types.JSONPatchType, payload, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	if client.Router != nil {
+		if err := client.Router.SetWeight(ctx, namespace, appName, canaryName, 0); err != nil {
+			log.Warnf("canary analysis %s/%s: resetting weight on promotion: %v", namespace, canaryName, err)
+		}
+	}
+	if err := client.Clientset.AppsV1().Deployments(namespace).Delete(ctx, canaryName, metav1.DeleteOptions{}); err != nil {
+		return err
+	}
+	if err := deleteCanaryResource(ctx, client.DynamicClient, namespace, canaryName); err != nil {
+		log.Warnf("canary analysis %s/%s: deleting canary resource on promotion: %v", namespace, canaryName, err)
+	}
+	return setCanaryEnabled(ctx, client.Clientset, namespace, appName, false)
+}
+
+func rollbackCanary(ctx context.Context, client *ClusterClient, namespace, appName, canaryName string) error {
+	if client.Router != nil {
+		if err := client.Router.SetWeight(ctx, namespace, appName, canaryName, 0); err != nil {
+			log.Warnf("canary analysis %s/%s: resetting weight on rollback: %v", namespace, canaryName, err)
+		}
+	}
+	if err := client.Clientset.AppsV1().Deployments(namespace).Delete(ctx, canaryName, metav1.DeleteOptions{}); err != nil {
+		return err
+	}
+	if err := deleteCanaryResource(ctx, client.DynamicClient, namespace, canaryName); err != nil {
+		log.Warnf("canary analysis %s/%s: deleting canary resource on rollback: %v", namespace, canaryName, err)
+	}
+	return setCanaryEnabled(ctx, client.Clientset, namespace, appName, false)
+}
+
+// getCanaryStatus reads the live analysis state off a canary Deployment's
+// annotations.
+func getCanaryStatus(ctx context.Context, client *ClusterClient, namespace, canaryName string) (*CanaryStatus, error) {
+	canary, err := client.Clientset.AppsV1().Deployments(namespace).Get(ctx, canaryName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return canaryStatusFromDeployment(*canary), nil
+}
+
+func canaryStatusFromDeployment(d appsv1.Deployment) *CanaryStatus {
+	weight, _ := strconv.ParseInt(d.Annotations[annCanaryWeight], 10, 32)
+	successful, _ := strconv.Atoi(d.Annotations[annCanarySuccessful])
+	failed, _ := strconv.Atoi(d.Annotations[annCanaryFailed])
+	maxWeightChecks, _ := strconv.Atoi(d.Annotations[annCanaryMaxWeightHits])
+	phase := CanaryPhase(d.Annotations[annCanaryPhase])
+	if phase == "" {
+		phase = CanaryProgressing
+	}
+	return &CanaryStatus{
+		CanaryName:       d.GetName(),
+		Phase:            phase,
+		Weight:           int32(weight),
+		SuccessfulChecks: successful,
+		FailedChecks:     failed,
+		MaxWeightChecks:  maxWeightChecks,
+	}
+}
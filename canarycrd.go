@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	crdv1 "github.com/inpulse-tv/devops-tool-htmx/api/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// canaryGVR identifies the Canary custom resource served by the CRD in
+// manifests/canary-crd.yaml.
+var canaryGVR = schema.GroupVersionResource{Group: crdv1.GroupName, Version: "v1", Resource: "canaries"}
+
+// createCanaryResource creates a Canary custom resource, returning the
+// server's view of it (populated metadata, UID, etc).
+func createCanaryResource(ctx context.Context, dynamicClient dynamic.Interface, namespace string, canary *crdv1.Canary) (*crdv1.Canary, error) {
+	canary.TypeMeta = metav1.TypeMeta{APIVersion: crdv1.GroupVersion.String(), Kind: "Canary"}
+	obj, err := canaryToUnstructured(canary)
+	if err != nil {
+		return nil, err
+	}
+	created, err := dynamicClient.Resource(canaryGVR).Namespace(namespace).Create(ctx, obj, metav1.CreateOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return canaryFromUnstructured(created)
+}
+
+// deleteCanaryResource deletes a Canary custom resource; the downstream
+// Deployment it owns is cleaned up by Kubernetes garbage collection via its
+// OwnerReference.
+func deleteCanaryResource(ctx context.Context, dynamicClient dynamic.Interface, namespace, name string) error {
+	err := dynamicClient.Resource(canaryGVR).Namespace(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// syncCanaryStatus writes a canary's analysis state onto its Canary
+// resource's status subresource, so `kubectl get canary` (and the CRD's
+// Phase/Weight printer columns) reflect the same state the analysis loop
+// persists as Deployment annotations. A missing Canary resource (e.g. one
+// created before this field existed, or already deleted) is not an error.
+func syncCanaryStatus(ctx context.Context, client *ClusterClient, namespace, canaryName string, phase CanaryPhase, weight int32) error {
+	obj, err := client.DynamicClient.Resource(canaryGVR).Namespace(namespace).Get(ctx, canaryName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	canary, err := canaryFromUnstructured(obj)
+	if err != nil {
+		return err
+	}
+
+	canary.Status.Phase = crdv1.CanaryPhase(phase)
+	canary.Status.Weight = weight
+	canary.Status.LastTransitionTime = metav1.NewTime(time.Now())
+
+	updated, err := canaryToUnstructured(canary)
+	if err != nil {
+		return err
+	}
+	_, err = client.DynamicClient.Resource(canaryGVR).Namespace(namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+func canaryToUnstructured(canary *crdv1.Canary) (*unstructured.Unstructured, error) {
+	m, err := runtime.DefaultUnstructuredConverter.ToUnstructured(canary)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: m}, nil
+}
+
+func canaryFromUnstructured(obj *unstructured.Unstructured) (*crdv1.Canary, error) {
+	canary := &crdv1.Canary{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, canary); err != nil {
+		return nil, err
+	}
+	return canary, nil
+}
+
+// canaryAnalysisSpecFromRequest converts the create_canary request's
+// CanaryAnalysis into the declarative form stored on the Canary resource.
+func canaryAnalysisSpecFromRequest(analysis *CanaryAnalysis) *crdv1.CanaryAnalysisSpec {
+	if analysis == nil {
+		return nil
+	}
+	metrics := make([]crdv1.CanaryMetricSpec, 0, len(analysis.Metrics))
+	for _, m := range analysis.Metrics {
+		metrics = append(metrics, crdv1.CanaryMetricSpec{Name: m.Name, Query: m.Query, Min: m.Min, Max: m.Max})
+	}
+	return &crdv1.CanaryAnalysisSpec{
+		PrometheusURL: analysis.PrometheusURL,
+		Interval:      analysis.Interval,
+		Threshold:     analysis.Threshold,
+		MaxWeight:     analysis.MaxWeight,
+		StepWeight:    analysis.StepWeight,
+		Iterations:    analysis.Iterations,
+		Metrics:       metrics,
+	}
+}
+
+// canaryAnalysisFromSpec converts a Canary resource's declarative analysis
+// block into the CanaryAnalysis the analysis loop in canary.go operates on.
+func canaryAnalysisFromSpec(spec crdv1.CanaryAnalysisSpec) CanaryAnalysis {
+	metrics := make([]CanaryMetric, 0, len(spec.Metrics))
+	for _, m := range spec.Metrics {
+		metrics = append(metrics, CanaryMetric{Name: m.Name, Query: m.Query, Min: m.Min, Max: m.Max})
+	}
+	return CanaryAnalysis{
+		PrometheusURL: spec.PrometheusURL,
+		Interval:      spec.Interval,
+		Threshold:     spec.Threshold,
+		MaxWeight:     spec.MaxWeight,
+		StepWeight:    spec.StepWeight,
+		Iterations:    spec.Iterations,
+		Metrics:       metrics,
+	}
+}
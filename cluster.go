@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/gofiber/fiber/v2/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// ClusterClient bundles everything the tool needs to talk to one cluster
+// context: a typed clientset, a dynamic client (for CRDs such as Istio's),
+// and the traffic router detected for that cluster.
+type ClusterClient struct {
+	Clientset     *kubernetes.Clientset
+	DynamicClient dynamic.Interface
+	Router        TrafficRouter
+}
+
+// ClusterRegistry holds one ClusterClient per context found in the
+// kubeconfig, so the tool can manage apps spread across several clusters
+// instead of assuming a single current-context clientset.
+type ClusterRegistry struct {
+	clients         map[string]*ClusterClient
+	watchNamespaces []string // empty or ["*"] means "list all namespaces"
+}
+
+// loadClusterRegistry builds a clientset (and traffic router) for every
+// context in the kubeconfig at kubeconfigPath. Contexts that fail to build
+// a working client are logged and skipped rather than failing startup.
+func loadClusterRegistry(kubeconfigPath string, watchNamespaces []string) (*ClusterRegistry, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfigPath
+	rawConfig, err := rules.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	registry := &ClusterRegistry{
+		clients:         map[string]*ClusterClient{},
+		watchNamespaces: watchNamespaces,
+	}
+
+	for contextName := range rawConfig.Contexts {
+		clientConfig := clientcmd.NewNonInteractiveClientConfig(*rawConfig, contextName, &clientcmd.ConfigOverrides{}, rules)
+		restConfig, err := clientConfig.ClientConfig()
+		if err != nil {
+			log.Warnf("cluster registry: skipping context %s: %v", contextName, err)
+			continue
+		}
+
+		clientset, err := kubernetes.NewForConfig(restConfig)
+		if err != nil {
+			log.Warnf("cluster registry: skipping context %s: %v", contextName, err)
+			continue
+		}
+
+		dynamicClient, err := dynamic.NewForConfig(restConfig)
+		if err != nil {
+			log.Warnf("cluster registry: skipping context %s: %v", contextName, err)
+			continue
+		}
+
+		router, err := newTrafficRouter(clientset.Discovery(), dynamicClient, clientset)
+		if err != nil {
+			log.Warnf("cluster registry: context %s: could not detect a traffic router: %v", contextName, err)
+		}
+
+		registry.clients[contextName] = &ClusterClient{
+			Clientset:     clientset,
+			DynamicClient: dynamicClient,
+			Router:        router,
+		}
+	}
+
+	return registry, nil
+}
+
+// Get returns the ClusterClient for a context name, or an error if the
+// kubeconfig has no such context.
+func (r *ClusterRegistry) Get(cluster string) (*ClusterClient, error) {
+	client, ok := r.clients[cluster]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", cluster)
+	}
+	return client, nil
+}
+
+// Clusters returns the configured context names, sorted for stable output.
+func (r *ClusterRegistry) Clusters() []string {
+	names := make([]string, 0, len(r.clients))
+	for name := range r.clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Namespaces returns the namespaces to list apps in for a cluster: the
+// operator-configured --watch-namespaces list, or every namespace in the
+// cluster when that flag is "*".
+func (r *ClusterRegistry) Namespaces(ctx context.Context, cluster string) ([]string, error) {
+	if len(r.watchNamespaces) > 0 && r.watchNamespaces[0] != "*" {
+		return r.watchNamespaces, nil
+	}
+
+	client, err := r.Get(cluster)
+	if err != nil {
+		return nil, err
+	}
+	list, err := client.Clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(list.Items))
+	for _, ns := range list.Items {
+		names = append(names, ns.GetName())
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	crdv1 "github.com/inpulse-tv/devops-tool-htmx/api/v1"
+
+	"github.com/gofiber/fiber/v2/log"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// canaryControllerResyncPeriod is how often the Canary informer relists, as
+// a backstop against a missed watch event.
+const canaryControllerResyncPeriod = 30 * time.Second
+
+// CanaryController reconciles Canary custom resources into an owned canary
+// Deployment. Creation/patch logic that used to live in the create_canary
+// Fiber handler now lives here instead: create_canary only creates a Canary
+// resource, and the controller creates the canary Deployment for it, owned
+// (via an OwnerReference) by that Canary. The controller does not manage the
+// app's Service selector or traffic weight: set_canary, set_weight and abort
+// still act on the Service, traffic router and canary Deployment directly.
+type CanaryController struct {
+	cluster string
+	client  *ClusterClient
+	queue   workqueue.RateLimitingInterface
+	lister  cache.GenericLister
+}
+
+// startCanaryControllers starts a CanaryController per cluster in the
+// registry, each watching Canary resources in that cluster.
+func startCanaryControllers(ctx context.Context, registry *ClusterRegistry) {
+	for _, cluster := range registry.Clusters() {
+		client, err := registry.Get(cluster)
+		if err != nil {
+			continue
+		}
+		startCanaryController(ctx, cluster, client)
+	}
+}
+
+func startCanaryController(ctx context.Context, cluster string, client *ClusterClient) {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client.DynamicClient, canaryControllerResyncPeriod, metav1.NamespaceAll, nil)
+	informer := factory.ForResource(canaryGVR).Informer()
+
+	controller := &CanaryController{
+		cluster: cluster,
+		client:  client,
+		queue:   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		lister:  cache.NewGenericLister(informer.GetIndexer(), canaryGVR.GroupResource()),
+	}
+
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    controller.enqueue,
+		UpdateFunc: func(_, newObj interface{}) { controller.enqueue(newObj) },
+		DeleteFunc: func(obj interface{}) {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			if err != nil {
+				return
+			}
+			namespace, name, err := cache.SplitMetaNamespaceKey(key)
+			if err != nil {
+				return
+			}
+			stopCanaryAnalysis(cluster, namespace, name)
+		},
+	})
+
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	go controller.run(ctx)
+	log.Infof("started canary controller for cluster %s", cluster)
+}
+
+func (c *CanaryController) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *CanaryController) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		c.queue.ShutDown()
+	}()
+	for c.processNextItem(ctx) {
+	}
+}
+
+func (c *CanaryController) processNextItem(ctx context.Context) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(ctx, key.(string)); err != nil {
+		log.Warnf("canary controller %s: reconciling %s: %v", c.cluster, key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile creates the owned canary Deployment for a Canary resource, with
+// an OwnerReference back to the Canary, the first time it's seen, and starts
+// its analysis loop. Once that Deployment exists, later changes to the
+// Canary's spec are not applied to it.
+func (c *CanaryController) reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	obj, err := c.lister.ByNamespace(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	unstructuredObj, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T for canary %s/%s", obj, namespace, name)
+	}
+	canary, err := canaryFromUnstructured(unstructuredObj)
+	if err != nil {
+		return err
+	}
+
+	k8s := c.client.Clientset
+	if _, err := k8s.AppsV1().Deployments(namespace).Get(ctx, canary.Name, metav1.GetOptions{}); err == nil {
+		return nil // owned Deployment already exists; the analysis loop owns it from here
+	} else if !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	target, err := k8s.AppsV1().Deployments(namespace).Get(ctx, canary.Spec.TargetDeployment, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("target deployment %s: %w", canary.Spec.TargetDeployment, err)
+	}
+	appName := target.GetLabels()["app"]
+	if appName == "" {
+		return fmt.Errorf("target deployment %s has no app label", canary.Spec.TargetDeployment)
+	}
+
+	replicas := canary.Spec.Replicas
+	canaryDeployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: canary.Name,
+			Labels: map[string]string{
+				"app": appName,
+			},
+			Annotations: map[string]string{
+				"devops-tool-htmx": "true",
+			},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(canary, crdv1.GroupVersion.WithKind("Canary"))},
+		},
+		Spec: target.Spec,
+	}
+	canaryDeployment.Labels["track"] = "canary"
+	canaryDeployment.Spec.Selector.MatchLabels["track"] = "canary"
+	canaryDeployment.Spec.Template.Labels["track"] = "canary"
+	canaryDeployment.Spec.Replicas = &replicas
+	canaryDeployment.Spec.Template.Spec.Containers[0].Image = canary.Spec.Image
+
+	if canary.Spec.Analysis != nil {
+		raw, err := json.Marshal(canaryAnalysisFromSpec(*canary.Spec.Analysis))
+		if err != nil {
+			return err
+		}
+		canaryDeployment.Annotations[annCanaryAnalysis] = string(raw)
+		canaryDeployment.Annotations[annCanaryPhase] = string(CanaryProgressing)
+	}
+
+	created, err := k8s.AppsV1().Deployments(namespace).Create(ctx, canaryDeployment, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if canary.Spec.Analysis != nil {
+		startCanaryAnalysis(c.client, c.cluster, namespace, appName, created.Name, canaryAnalysisFromSpec(*canary.Spec.Analysis))
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const informerResyncPeriod = 30 * time.Second
+
+// startInformers starts a SharedInformerFactory per cluster watching
+// Deployments, Endpoints and Services, and keeps stateStore current from
+// their Add/Update/Delete callbacks instead of per-request List/Get calls.
+func startInformers(ctx context.Context, registry *ClusterRegistry, store *StateStore) {
+	for _, cluster := range registry.Clusters() {
+		client, err := registry.Get(cluster)
+		if err != nil {
+			continue
+		}
+		startClusterInformers(ctx, cluster, client, store)
+	}
+}
+
+func startClusterInformers(ctx context.Context, cluster string, client *ClusterClient, store *StateStore) {
+	factory := informers.NewSharedInformerFactory(client.Clientset, informerResyncPeriod)
+	deployments := factory.Apps().V1().Deployments()
+	endpoints := factory.Core().V1().Endpoints()
+	services := factory.Core().V1().Services()
+
+	// knownApps tracks which (cluster, namespace, app name) the tool
+	// actually manages, learned from Deployment events. Endpoints and
+	// Services are otherwise keyed only by their own name cluster-wide, so
+	// without this filter every unrelated object (e.g. a kube-system
+	// Service) would trigger a state rebuild keyed on its name as if it
+	// were a managed app.
+	var knownApps sync.Map
+
+	refresh := func(namespace, appName string) {
+		state, err := buildAppStateFromCache(ctx, client, deployments.Lister(), endpoints.Lister(), services.Lister(), namespace, appName)
+		if err != nil {
+			log.Warnf("refreshing state for %s/%s/%s: %v", cluster, namespace, appName, err)
+			return
+		}
+		store.Set(appKey{cluster: cluster, namespace: namespace, name: appName}, state)
+	}
+
+	onDeploymentChange := func(obj interface{}) {
+		obj = unwrapTombstone(obj)
+		d, ok := obj.(*appsv1.Deployment)
+		if !ok {
+			return
+		}
+		appName := d.GetLabels()["app"]
+		if appName == "" {
+			return
+		}
+		knownApps.Store(appKey{cluster: cluster, namespace: d.GetNamespace(), name: appName}, struct{}{})
+		refresh(d.GetNamespace(), appName)
+	}
+	deployments.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    onDeploymentChange,
+		UpdateFunc: func(_, newObj interface{}) { onDeploymentChange(newObj) },
+		DeleteFunc: onDeploymentChange,
+	})
+
+	onNamedObjectChange := func(namespace, name string) {
+		if _, known := knownApps.Load(appKey{cluster: cluster, namespace: namespace, name: name}); !known {
+			return
+		}
+		refresh(namespace, name)
+	}
+
+	endpoints.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if e, ok := obj.(*v1.Endpoints); ok {
+				onNamedObjectChange(e.GetNamespace(), e.GetName())
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if e, ok := newObj.(*v1.Endpoints); ok {
+				onNamedObjectChange(e.GetNamespace(), e.GetName())
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if e, ok := unwrapTombstone(obj).(*v1.Endpoints); ok {
+				onNamedObjectChange(e.GetNamespace(), e.GetName())
+			}
+		},
+	})
+
+	services.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if s, ok := obj.(*v1.Service); ok {
+				onNamedObjectChange(s.GetNamespace(), s.GetName())
+			}
+		},
+		UpdateFunc: func(_, newObj interface{}) {
+			if s, ok := newObj.(*v1.Service); ok {
+				onNamedObjectChange(s.GetNamespace(), s.GetName())
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if s, ok := unwrapTombstone(obj).(*v1.Service); ok {
+				onNamedObjectChange(s.GetNamespace(), s.GetName())
+			}
+		},
+	})
+
+	factory.Start(ctx.Done())
+	log.Infof("started informers for cluster %s", cluster)
+}
+
+// unwrapTombstone recovers the deleted object from a
+// cache.DeletedFinalStateUnknown tombstone, which informers deliver to
+// DeleteFunc when a delete was observed during a watch relist instead of a
+// live watch event. Without this, a delete of a known app's Deployment,
+// Endpoints or Service that arrives as a tombstone fails the type assertion
+// and is silently dropped, leaving the app stuck in stateStore.
+func unwrapTombstone(obj interface{}) interface{} {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return tombstone.Obj
+	}
+	return obj
+}
+
+// buildAppStateFromCache assembles an app's state from the informers'
+// listers instead of the API server, so an informer event doesn't trade one
+// set of live List/Get calls for another.
+func buildAppStateFromCache(ctx context.Context, client *ClusterClient, deployments appslisters.DeploymentLister, endpoints corelisters.EndpointsLister, services corelisters.ServiceLister, namespace, name string) (*AppStateResponse, error) {
+	selector := labels.SelectorFromSet(labels.Set{"app": name})
+	matched, err := deployments.Deployments(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+	items := make([]appsv1.Deployment, len(matched))
+	for i, d := range matched {
+		items[i] = *d
+	}
+
+	endpoint, err := endpoints.Endpoints(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	svc, err := services.Services(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return assembleAppState(ctx, client, namespace, name, items, endpoint, svc), nil
+}
@@ -8,7 +8,8 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"time"
+
+	crdv1 "github.com/inpulse-tv/devops-tool-htmx/api/v1"
 
 	"github.com/docker/docker/pkg/namesgenerator"
 	"github.com/gofiber/fiber/v2"
@@ -20,7 +21,6 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
 )
 
@@ -30,6 +30,7 @@ type Deployment struct {
 	Track             string `json:"track"`
 	Replicas          int32  `json:"replicas"`
 	AvailableReplicas int32  `json:"availableReplicas"`
+	Weight            int32  `json:"weight"`
 }
 
 type Endpoint struct {
@@ -38,14 +39,21 @@ type Endpoint struct {
 }
 
 type AppStateResponse struct {
-	CanaryEnabled bool         `json:"canaryEnabled"`
-	Deployments   []Deployment `json:"deployments"`
-	Endpoints     []Endpoint   `json:"endpoints"`
+	CanaryEnabled  bool           `json:"canaryEnabled"`
+	Deployments    []Deployment   `json:"deployments"`
+	Endpoints      []Endpoint     `json:"endpoints"`
+	CanaryStatuses []CanaryStatus `json:"canaryStatuses,omitempty"`
 }
 
 type CanaryCreateRequest struct {
-	Tag      string `json:"tag" xml:"tag" form:"tag"`
-	Replicas int32  `json:"replicas" xml:"replicas" form:"replicas"`
+	Tag      string          `json:"tag" xml:"tag" form:"tag"`
+	Replicas int32           `json:"replicas" xml:"replicas" form:"replicas"`
+	Analysis *CanaryAnalysis `json:"analysis"`
+}
+
+type SetWeightRequest struct {
+	Weight     int32  `json:"weight" xml:"weight" form:"weight"`
+	CanaryName string `json:"canaryName" xml:"canaryName" form:"canaryName"`
 }
 
 type jsonPatchOp struct {
@@ -55,6 +63,10 @@ type jsonPatchOp struct {
 	Value interface{} `json:"value"`
 }
 
+// stateStore is the informer-backed cache GetAppState reads from, kept
+// current by the per-cluster informers started in startInformers.
+var stateStore = newStateStore()
+
 func asCustomDeployment(deployments []appsv1.Deployment) []Deployment {
 	customDeployments := []Deployment{}
 	for _, v := range deployments {
@@ -82,18 +94,61 @@ func asCustomEndpoint(endpoints []v1.EndpointAddress) []Endpoint {
 	return customEndpoints
 }
 
-func GetAppState(name string, ctx context.Context, k8s *kubernetes.Clientset) (*AppStateResponse, error) {
+// GetAppState returns an app's state from the informer-backed cache,
+// falling back to a live fetch (and populating the cache) on a miss -
+// e.g. the very first request for an app, before its informers have synced.
+func GetAppState(ctx context.Context, registry *ClusterRegistry, cluster, namespace, name string) (*AppStateResponse, error) {
+	key := appKey{cluster: cluster, namespace: namespace, name: name}
+	if state, ok := stateStore.Get(key); ok {
+		return state, nil
+	}
+
+	client, err := registry.Get(cluster)
+	if err != nil {
+		return nil, err
+	}
+	state, err := fetchAppState(ctx, client, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	stateStore.Set(key, state)
+	return state, nil
+}
+
+// fetchAppState does a live read of an app's Deployments, Endpoints and
+// Service straight from the Kubernetes API.
+func fetchAppState(ctx context.Context, client *ClusterClient, namespace, name string) (*AppStateResponse, error) {
+	k8s := client.Clientset
+
 	labelSelector := metav1.AddLabelToSelector(&metav1.LabelSelector{}, "app", name)
 	options := metav1.ListOptions{
 		LabelSelector: metav1.FormatLabelSelector(labelSelector),
 	}
-	deployments, err := k8s.AppsV1().Deployments("default").List(ctx, options)
+	deployments, err := k8s.AppsV1().Deployments(namespace).List(ctx, options)
 	if err != nil {
 		return nil, err
 	}
 
+	endpoint, err := k8s.CoreV1().Endpoints(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	svc, err := k8s.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return assembleAppState(ctx, client, namespace, name, deployments.Items, endpoint, svc), nil
+}
+
+// assembleAppState turns a raw Deployment list plus the app's Endpoints and
+// Service into an AppStateResponse. It's shared by fetchAppState's live
+// reads and the informer-driven refresh in informer.go, which assembles the
+// same inputs from its cache instead of hitting the API server.
+func assembleAppState(ctx context.Context, client *ClusterClient, namespace, name string, deployments []appsv1.Deployment, endpoint *v1.Endpoints, svc *v1.Service) *AppStateResponse {
 	managedDeployments := []appsv1.Deployment{}
-	for _, v := range deployments.Items {
+	for _, v := range deployments {
 		managed, err := strconv.ParseBool(v.Annotations["devops-tool-htmx"])
 		if err != nil {
 			continue
@@ -106,15 +161,6 @@ func GetAppState(name string, ctx context.Context, k8s *kubernetes.Clientset) (*
 		}
 	}
 
-	endpoint, err := k8s.CoreV1().Endpoints("default").Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-
-	svc, err := k8s.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
 	addresses := []v1.EndpointAddress{}
 	if len(endpoint.Subsets) > 0 {
 		addresses = endpoint.Subsets[0].Addresses
@@ -122,15 +168,62 @@ func GetAppState(name string, ctx context.Context, k8s *kubernetes.Clientset) (*
 
 	canaryEnabled := !(svc.Spec.Selector["track"] == "main")
 
+	canaryStatuses := []CanaryStatus{}
+	for _, v := range managedDeployments {
+		if v.GetLabels()["track"] != "canary" {
+			continue
+		}
+		canaryStatuses = append(canaryStatuses, *canaryStatusFromDeployment(v))
+	}
+
+	customDeployments := asCustomDeployment(managedDeployments)
+	if client.Router != nil {
+		if weight, err := client.Router.GetWeight(ctx, namespace, name); err == nil {
+			for i := range customDeployments {
+				switch customDeployments[i].Track {
+				case "canary":
+					customDeployments[i].Weight = weight
+				case "main":
+					customDeployments[i].Weight = 100 - weight
+				}
+			}
+		}
+	}
+
 	return &AppStateResponse{
-		CanaryEnabled: canaryEnabled,
-		Deployments:   asCustomDeployment(managedDeployments),
-		Endpoints:     asCustomEndpoint(addresses),
-	}, nil
+		CanaryEnabled:  canaryEnabled,
+		Deployments:    customDeployments,
+		Endpoints:      asCustomEndpoint(addresses),
+		CanaryStatuses: canaryStatuses,
+	}
 }
 
-func renderApp(c *fiber.Ctx, name string, appState AppStateResponse) error {
+// setCanaryEnabled flips the app's Service selector between routing only to
+// `track=main` and routing to every track (main and canary alike).
+func setCanaryEnabled(ctx context.Context, clientset *kubernetes.Clientset, namespace, name string, enabled bool) error {
+	patch := []jsonPatchOp{
+		{
+			Op:    "add",
+			Path:  "/spec/selector/track",
+			Value: "main",
+			From:  "",
+		},
+	}
+	if enabled {
+		patch[0].Op = "remove"
+	}
+	payload, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Services(namespace).Patch(ctx, name, types.JSONPatchType, payload, metav1.PatchOptions{})
+	return err
+}
+
+func renderApp(c *fiber.Ctx, cluster, namespace, name string, appState AppStateResponse) error {
 	return c.Render("app", fiber.Map{
+		"Cluster":       cluster,
+		"Namespace":     namespace,
 		"Name":          name,
 		"CanaryEnabled": appState.CanaryEnabled,
 		"Endpoints":     appState.Endpoints,
@@ -138,6 +231,23 @@ func renderApp(c *fiber.Ctx, name string, appState AppStateResponse) error {
 	})
 }
 
+// parseWatchNamespaces splits the --watch-namespaces flag value into a
+// namespace list, treating "*" (or an empty value) as "every namespace".
+func parseWatchNamespaces(raw string) []string {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || raw == "*" {
+		return []string{"*"}
+	}
+	parts := strings.Split(raw, ",")
+	namespaces := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			namespaces = append(namespaces, p)
+		}
+	}
+	return namespaces
+}
+
 func main() {
 	engine := html.New("./views", ".html")
 
@@ -155,136 +265,215 @@ func main() {
 	} else {
 		kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
 	}
+	watchNamespaces := flag.String("watch-namespaces", "*", "comma-separated namespaces to list apps in, or \"*\" for all namespaces")
 	flag.Parse()
 
-	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	registry, err := loadClusterRegistry(*kubeconfig, parseWatchNamespaces(*watchNamespaces))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		log.Fatal(err)
-	}
+	resumeCanaryAnalyses(context.Background(), registry)
+	startInformers(context.Background(), registry, stateStore)
+	startCanaryControllers(context.Background(), registry)
 
 	app.Get("/", func(c *fiber.Ctx) error {
-		apps := make(map[string]bool)
-		deployments, err := clientset.AppsV1().Deployments("default").List(c.Context(), metav1.ListOptions{})
-		if err != nil {
-			return err
-		}
-		for _, v := range deployments.Items {
-			app := v.GetLabels()["app"]
-			if app != "" {
-				apps[app] = true
+		ctx := c.Context()
+		apps := make(map[string]map[string][]string) // cluster -> namespace -> app names
+		for _, cluster := range registry.Clusters() {
+			client, err := registry.Get(cluster)
+			if err != nil {
+				return err
+			}
+			namespaces, err := registry.Namespaces(ctx, cluster)
+			if err != nil {
+				return err
+			}
+			apps[cluster] = make(map[string][]string)
+			for _, namespace := range namespaces {
+				deployments, err := client.Clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+				if err != nil {
+					return err
+				}
+				seen := make(map[string]bool)
+				names := []string{}
+				for _, v := range deployments.Items {
+					appName := v.GetLabels()["app"]
+					if appName != "" && !seen[appName] {
+						seen[appName] = true
+						names = append(names, appName)
+					}
+				}
+				apps[cluster][namespace] = names
 			}
-		}
-		keys := make([]string, 0, len(apps))
-		for k := range apps {
-			keys = append(keys, k)
 		}
 		return c.Render("index", fiber.Map{
-			"Apps": keys,
+			"Apps": apps,
 		})
 	})
 
-	app.Get("/app", func(c *fiber.Ctx) error {
-		return c.Redirect(c.Query("name"))
+	app.Get("/clusters", func(c *fiber.Ctx) error {
+		return c.JSON(registry.Clusters())
+	})
+
+	app.Get("/cluster/:cluster/ns/:ns/app", func(c *fiber.Ctx) error {
+		return c.Redirect(fmt.Sprintf("/cluster/%s/ns/%s/app/%s", c.Params("cluster"), c.Params("ns"), c.Query("name")))
 	})
 
-	app.Get("/app/:name", func(c *fiber.Ctx) error {
+	app.Get("/cluster/:cluster/ns/:ns/app/:name", func(c *fiber.Ctx) error {
+		cluster := c.Params("cluster")
+		namespace := c.Params("ns")
 		name := c.Params("name")
-		appState, err := GetAppState(name, c.Context(), clientset)
+		appState, err := GetAppState(c.Context(), registry, cluster, namespace, name)
 		if err != nil {
 			return err
 		}
 		htmx, _ := strconv.ParseBool(c.Get("HX-Request", "false"))
 		if htmx {
-			return renderApp(c, name, *appState)
+			return renderApp(c, cluster, namespace, name, *appState)
 		}
 		return c.JSON(appState)
 	})
 
-	app.Post("/app/:name/create_canary", func(c *fiber.Ctx) error {
+	app.Post("/cluster/:cluster/ns/:ns/app/:name/create_canary", func(c *fiber.Ctx) error {
+		cluster := c.Params("cluster")
+		namespace := c.Params("ns")
+		name := c.Params("name")
+		client, err := registry.Get(cluster)
+		if err != nil {
+			return err
+		}
+
 		req := &CanaryCreateRequest{}
-		err := c.BodyParser(req)
+		err = c.BodyParser(req)
 		if err != nil {
 			return err
 		}
-		name := c.Params("name")
-		deployment, err := clientset.AppsV1().Deployments("default").Get(c.Context(), name, metav1.GetOptions{})
+		deployment, err := client.Clientset.AppsV1().Deployments(namespace).Get(c.Context(), name, metav1.GetOptions{})
 		if err != nil {
 			return err
-
 		}
-		canary_deployment := &appsv1.Deployment{
+
+		canaryName := fmt.Sprintf("%s-canary-%s", name, strings.ReplaceAll(namesgenerator.GetRandomName(0), "_", "-"))
+		imageSplit := strings.SplitN(deployment.Spec.Template.Spec.Containers[0].Image, ":", 2)
+
+		canary := &crdv1.Canary{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: fmt.Sprintf("%s-canary-%s", name, strings.ReplaceAll(namesgenerator.GetRandomName(0), "_", "-")),
-				Labels: map[string]string{
-					"app": "nginx",
-				},
-				Annotations: map[string]string{
-					"devops-tool-htmx": "true",
-				},
+				Name:      canaryName,
+				Namespace: namespace,
+			},
+			Spec: crdv1.CanarySpec{
+				TargetDeployment: name,
+				Image:            fmt.Sprintf("%s:%s", imageSplit[0], req.Tag),
+				Replicas:         req.Replicas,
+				Analysis:         canaryAnalysisSpecFromRequest(req.Analysis),
 			},
-			Spec: deployment.Spec,
 		}
-		canary_deployment.ObjectMeta.Labels["track"] = "canary"
-		canary_deployment.Spec.Selector.MatchLabels["track"] = "canary"
-		canary_deployment.Spec.Template.ObjectMeta.Labels["track"] = "canary"
-
-		canary_deployment.Spec.Replicas = &req.Replicas
+		if _, err := createCanaryResource(c.Context(), client.DynamicClient, namespace, canary); err != nil {
+			return err
+		}
 
-		imageSplit := strings.SplitN(canary_deployment.Spec.Template.Spec.Containers[0].Image, ":", 2)
-		canary_deployment.Spec.Template.Spec.Containers[0].Image = fmt.Sprintf("%s:%s", imageSplit[0], req.Tag)
+		appState, err := GetAppState(c.Context(), registry, cluster, namespace, name)
+		if err != nil {
+			return err
+		}
+		htmx, _ := strconv.ParseBool(c.Get("HX-Request", "false"))
+		if htmx {
+			return renderApp(c, cluster, namespace, name, *appState)
+		}
+		return c.JSON(appState)
+	})
 
-		_, err = clientset.AppsV1().Deployments("default").Create(c.Context(), canary_deployment, metav1.CreateOptions{})
+	app.Get("/cluster/:cluster/ns/:ns/app/:name/set_canary", func(c *fiber.Ctx) error {
+		cluster := c.Params("cluster")
+		namespace := c.Params("ns")
+		name := c.Params("name")
+		client, err := registry.Get(cluster)
 		if err != nil {
 			return err
 		}
-		appState, err := GetAppState(c.Params("name"), c.Context(), clientset)
+		enabled := c.QueryBool("enabled")
+		if err := setCanaryEnabled(c.Context(), client.Clientset, namespace, name, enabled); err != nil {
+			return err
+		}
+
+		appState, err := GetAppState(c.Context(), registry, cluster, namespace, name)
 		if err != nil {
 			return err
 		}
 		htmx, _ := strconv.ParseBool(c.Get("HX-Request", "false"))
 		if htmx {
-			return renderApp(c, name, *appState)
+			return renderApp(c, cluster, namespace, name, *appState)
 		}
 		return c.JSON(appState)
 	})
 
-	app.Get("/app/:name/set_canary", func(c *fiber.Ctx) error {
-		enabled := c.QueryBool("enabled")
+	app.Post("/cluster/:cluster/ns/:ns/app/:name/set_weight", func(c *fiber.Ctx) error {
+		cluster := c.Params("cluster")
+		namespace := c.Params("ns")
 		name := c.Params("name")
-		patch := []jsonPatchOp{
-			{
-				Op:    "add",
-				Path:  "/spec/selector/track",
-				Value: "main",
-				From:  "",
-			},
+		client, err := registry.Get(cluster)
+		if err != nil {
+			return err
 		}
-		if enabled {
-			patch[0].Op = "remove"
+		req := &SetWeightRequest{}
+		if err := c.BodyParser(req); err != nil {
+			return err
 		}
-		payload, err := json.Marshal(patch)
-		if err != nil {
+		if client.Router == nil {
+			return fmt.Errorf("cluster %s has no traffic router available", cluster)
+		}
+		if err := client.Router.SetWeight(c.Context(), namespace, name, req.CanaryName, req.Weight); err != nil {
 			return err
 		}
-		_, err = clientset.CoreV1().Services("default").Patch(c.Context(), name, types.JSONPatchType, payload, metav1.PatchOptions{})
+		appState, err := GetAppState(c.Context(), registry, cluster, namespace, name)
 		if err != nil {
 			return err
 		}
+		htmx, _ := strconv.ParseBool(c.Get("HX-Request", "false"))
+		if htmx {
+			return renderApp(c, cluster, namespace, name, *appState)
+		}
+		return c.JSON(appState)
+	})
 
-		time.Sleep(100 * time.Millisecond)
+	app.Get("/cluster/:cluster/ns/:ns/app/:name/events", func(c *fiber.Ctx) error {
+		key := appKey{cluster: c.Params("cluster"), namespace: c.Params("ns"), name: c.Params("name")}
+		return streamAppEvents(c, registry, engine, key)
+	})
 
-		appState, err := GetAppState(c.Params("name"), c.Context(), clientset)
+	app.Get("/cluster/:cluster/ns/:ns/app/:name/canary/:canaryName/status", func(c *fiber.Ctx) error {
+		client, err := registry.Get(c.Params("cluster"))
+		if err != nil {
+			return err
+		}
+		status, err := getCanaryStatus(c.Context(), client, c.Params("ns"), c.Params("canaryName"))
+		if err != nil {
+			return err
+		}
+		return c.JSON(status)
+	})
+
+	app.Post("/cluster/:cluster/ns/:ns/app/:name/canary/:canaryName/abort", func(c *fiber.Ctx) error {
+		cluster := c.Params("cluster")
+		namespace := c.Params("ns")
+		name := c.Params("name")
+		canaryName := c.Params("canaryName")
+		client, err := registry.Get(cluster)
+		if err != nil {
+			return err
+		}
+		stopCanaryAnalysis(cluster, namespace, canaryName)
+		if err := rollbackCanary(c.Context(), client, namespace, name, canaryName); err != nil {
+			return err
+		}
+		appState, err := GetAppState(c.Context(), registry, cluster, namespace, name)
 		if err != nil {
 			return err
 		}
 		htmx, _ := strconv.ParseBool(c.Get("HX-Request", "false"))
 		if htmx {
-			return renderApp(c, name, *appState)
+			return renderApp(c, cluster, namespace, name, *appState)
 		}
 		return c.JSON(appState)
 	})
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/valyala/fasthttp"
+)
+
+// streamAppEvents serves GET .../events as text/event-stream, pushing an
+// hx-swap-oob HTMX fragment for the app's deployments and endpoints every
+// time stateStore's debounced notification fires for this key.
+func streamAppEvents(c *fiber.Ctx, registry *ClusterRegistry, views fiber.Views, key appKey) error {
+	ch, unsubscribe := stateStore.Subscribe(key)
+
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+
+	ctx := c.Context()
+	ctx.SetBodyStreamWriter(fasthttp.StreamWriter(func(w *bufio.Writer) {
+		defer unsubscribe()
+		for {
+			select {
+			case <-ch:
+				appState, err := GetAppState(ctx, registry, key.cluster, key.namespace, key.name)
+				if err != nil {
+					return
+				}
+				fragment, err := renderEventFragment(views, *appState)
+				if err != nil {
+					return
+				}
+				if _, err := w.WriteString(sseEvent("app-update", fragment)); err != nil {
+					return
+				}
+				if err := w.Flush(); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}))
+
+	return nil
+}
+
+// renderEventFragment renders the deployment-card and endpoint-row HTMX
+// partials (each templated with hx-swap-oob so HTMX patches them in place)
+// for an SSE push.
+func renderEventFragment(views fiber.Views, appState AppStateResponse) (string, error) {
+	var buf bytes.Buffer
+	if err := views.Render(&buf, "partials/deployment-cards", fiber.Map{"Deployments": appState.Deployments}); err != nil {
+		return "", err
+	}
+	if err := views.Render(&buf, "partials/endpoint-rows", fiber.Map{"Endpoints": appState.Endpoints}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sseEvent formats data as a Server-Sent Event, prefixing every line of a
+// (possibly multi-line, HTML) payload with "data: " per the SSE spec.
+func sseEvent(event, data string) string {
+	var sb strings.Builder
+	sb.WriteString("event: ")
+	sb.WriteString(event)
+	sb.WriteString("\n")
+	for _, line := range strings.Split(data, "\n") {
+		sb.WriteString("data: ")
+		sb.WriteString(line)
+		sb.WriteString("\n")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
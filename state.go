@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const stateDebounce = 250 * time.Millisecond
+
+// appKey identifies one app's cached state: the cluster it lives in, the
+// namespace within that cluster, and its app name.
+type appKey struct {
+	cluster   string
+	namespace string
+	name      string
+}
+
+// StateStore is an in-memory cache of AppStateResponse keyed by
+// (cluster, namespace, app name), kept current by Kubernetes informer
+// callbacks instead of per-request List/Get calls. Subscribers (the SSE
+// handler) are notified after a debounce window so a burst of informer
+// events during a rollout collapses into a single push.
+type StateStore struct {
+	mu        sync.Mutex
+	state     map[appKey]*AppStateResponse
+	subs      map[appKey]map[int]chan struct{}
+	nextSubID int
+	timers    map[appKey]*time.Timer
+}
+
+func newStateStore() *StateStore {
+	return &StateStore{
+		state:  map[appKey]*AppStateResponse{},
+		subs:   map[appKey]map[int]chan struct{}{},
+		timers: map[appKey]*time.Timer{},
+	}
+}
+
+// Get returns the cached state for key, if any.
+func (s *StateStore) Get(key appKey) (*AppStateResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state, ok := s.state[key]
+	return state, ok
+}
+
+// Set updates the cached state for key and schedules a debounced
+// notification to its subscribers.
+func (s *StateStore) Set(key appKey, state *AppStateResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state[key] = state
+	if timer, ok := s.timers[key]; ok {
+		timer.Stop()
+	}
+	s.timers[key] = time.AfterFunc(stateDebounce, func() { s.publish(key) })
+}
+
+func (s *StateStore) publish(key appKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ch := range s.subs[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a channel that receives a notification (coalesced,
+// non-blocking) every time key's cached state changes. The returned func
+// unregisters it.
+func (s *StateStore) Subscribe(key appKey) (<-chan struct{}, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[key] == nil {
+		s.subs[key] = map[int]chan struct{}{}
+	}
+	id := s.nextSubID
+	s.nextSubID++
+	ch := make(chan struct{}, 1)
+	s.subs[key][id] = ch
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.subs[key], id)
+	}
+}
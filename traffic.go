@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2/log"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const istioAPIGroup = "networking.istio.io"
+
+var (
+	virtualServiceGVR  = schema.GroupVersionResource{Group: istioAPIGroup, Version: "v1beta1", Resource: "virtualservices"}
+	destinationRuleGVR = schema.GroupVersionResource{Group: istioAPIGroup, Version: "v1beta1", Resource: "destinationrules"}
+)
+
+// TrafficRouter reconciles the main/canary traffic split for an app onto
+// whichever mesh or ingress controller is actually installed in the
+// cluster, so callers don't need to know whether they're driving an Istio
+// VirtualService or an nginx-ingress annotation.
+type TrafficRouter interface {
+	SetWeight(ctx context.Context, namespace, appName, canaryName string, weight int32) error
+	GetWeight(ctx context.Context, namespace, appName string) (int32, error)
+}
+
+// newTrafficRouter probes the cluster for the networking.istio.io API group
+// and returns an Istio-backed router when it's present, falling back to
+// nginx-ingress canary annotations otherwise.
+func newTrafficRouter(discoveryClient discovery.DiscoveryInterface, dynamicClient dynamic.Interface, clientset *kubernetes.Clientset) (TrafficRouter, error) {
+	groups, err := discoveryClient.ServerGroups()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups.Groups {
+		if g.Name == istioAPIGroup {
+			log.Infof("detected %s, using the Istio traffic router", istioAPIGroup)
+			return &istioTrafficRouter{dynamicClient: dynamicClient}, nil
+		}
+	}
+	log.Warnf("%s not found; falling back to nginx-ingress canary annotations for traffic weighting", istioAPIGroup)
+	return &nginxTrafficRouter{clientset: clientset}, nil
+}
+
+// istioTrafficRouter reconciles a VirtualService (two HTTPRouteDestinations,
+// weights summing to 100) and a DestinationRule (subsets keyed on the
+// `track` label) named after the app.
+type istioTrafficRouter struct {
+	dynamicClient dynamic.Interface
+}
+
+func (r *istioTrafficRouter) SetWeight(ctx context.Context, namespace, appName, canaryName string, weight int32) error {
+	if err := r.reconcileDestinationRule(ctx, namespace, appName); err != nil {
+		return err
+	}
+	return r.reconcileVirtualService(ctx, namespace, appName, weight)
+}
+
+func (r *istioTrafficRouter) GetWeight(ctx context.Context, namespace, appName string) (int32, error) {
+	vs, err := r.dynamicClient.Resource(virtualServiceGVR).Namespace(namespace).Get(ctx, appName, metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	routes, found, err := unstructured.NestedSlice(vs.Object, "spec", "http")
+	if err != nil || !found || len(routes) == 0 {
+		return 0, fmt.Errorf("virtualservice %s/%s has no http routes", namespace, appName)
+	}
+	route, ok := routes[0].(map[string]interface{})
+	if !ok {
+		return 0, fmt.Errorf("virtualservice %s/%s has a malformed http route", namespace, appName)
+	}
+	destinations, found, err := unstructured.NestedSlice(route, "route")
+	if err != nil || !found {
+		return 0, fmt.Errorf("virtualservice %s/%s route has no destinations", namespace, appName)
+	}
+	for _, d := range destinations {
+		dest, ok := d.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		subset, _, _ := unstructured.NestedString(dest, "destination", "subset")
+		if subset != "canary" {
+			continue
+		}
+		weight, _, _ := unstructured.NestedInt64(dest, "weight")
+		return int32(weight), nil
+	}
+	return 0, fmt.Errorf("virtualservice %s/%s has no canary subset", namespace, appName)
+}
+
+func (r *istioTrafficRouter) reconcileDestinationRule(ctx context.Context, namespace, appName string) error {
+	dr := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind":       "DestinationRule",
+		"metadata": map[string]interface{}{
+			"name":      appName,
+			"namespace": namespace,
+		},
+		"spec": map[string]interface{}{
+			"host": appName,
+			"subsets": []interface{}{
+				map[string]interface{}{"name": "main", "labels": map[string]interface{}{"track": "main"}},
+				map[string]interface{}{"name": "canary", "labels": map[string]interface{}{"track": "canary"}},
+			},
+		},
+	}}
+	return r.applyUnstructured(ctx, namespace, destinationRuleGVR, dr)
+}
+
+func (r *istioTrafficRouter) reconcileVirtualService(ctx context.Context, namespace, appName string, weight int32) error {
+	vs := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind":       "VirtualService",
+		"metadata": map[string]interface{}{
+			"name":      appName,
+			"namespace": namespace,
+		},
+		"spec": map[string]interface{}{
+			"hosts": []interface{}{appName},
+			"http": []interface{}{
+				map[string]interface{}{
+					"route": []interface{}{
+						map[string]interface{}{
+							"destination": map[string]interface{}{"host": appName, "subset": "main"},
+							"weight":      int64(100 - weight),
+						},
+						map[string]interface{}{
+							"destination": map[string]interface{}{"host": appName, "subset": "canary"},
+							"weight":      int64(weight),
+						},
+					},
+				},
+			},
+		},
+	}}
+	return r.applyUnstructured(ctx, namespace, virtualServiceGVR, vs)
+}
+
+func (r *istioTrafficRouter) applyUnstructured(ctx context.Context, namespace string, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	client := r.dynamicClient.Resource(gvr).Namespace(namespace)
+	existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err := client.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	obj.SetResourceVersion(existing.GetResourceVersion())
+	_, err = client.Update(ctx, obj, metav1.UpdateOptions{})
+	return err
+}
+
+const (
+	nginxCanaryAnnotation       = "nginx.ingress.kubernetes.io/canary"
+	nginxCanaryWeightAnnotation = "nginx.ingress.kubernetes.io/canary-weight"
+)
+
+// nginxTrafficRouter is the fallback selected when Istio isn't installed.
+// nginx-ingress only honors its canary annotations on a *second* Ingress
+// that shadows the primary one (same host/path rules, pointed at a
+// canary-only Service) - annotating the app's own Ingress doesn't split
+// traffic and risks breaking its routing. SetWeight therefore reconciles
+// both a canary Service (selecting `track=canary`, since the app's shared
+// Service load-balances across every track once canary traffic is enabled
+// and can't express a weighted split on its own) and a shadow Ingress
+// cloned from the primary one, with its backends repointed at that Service.
+type nginxTrafficRouter struct {
+	clientset *kubernetes.Clientset
+}
+
+func canaryServiceName(appName string) string { return appName + "-canary" }
+
+func canaryIngressName(appName string) string { return appName + "-canary" }
+
+func (r *nginxTrafficRouter) SetWeight(ctx context.Context, namespace, appName, canaryName string, weight int32) error {
+	if err := r.reconcileCanaryService(ctx, namespace, appName); err != nil {
+		return fmt.Errorf("reconciling canary service for %s/%s: %w", namespace, appName, err)
+	}
+	if err := r.reconcileShadowIngress(ctx, namespace, appName, weight); err != nil {
+		return fmt.Errorf("reconciling shadow ingress for %s/%s: %w", namespace, appName, err)
+	}
+	return nil
+}
+
+func (r *nginxTrafficRouter) GetWeight(ctx context.Context, namespace, appName string) (int32, error) {
+	ingress, err := r.clientset.NetworkingV1().Ingresses(namespace).Get(ctx, canaryIngressName(appName), metav1.GetOptions{})
+	if err != nil {
+		return 0, err
+	}
+	weight, err := strconv.ParseInt(ingress.Annotations[nginxCanaryWeightAnnotation], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("shadow ingress %s/%s has no usable %s annotation: %w", namespace, ingress.Name, nginxCanaryWeightAnnotation, err)
+	}
+	return int32(weight), nil
+}
+
+// reconcileCanaryService ensures a Service named after canaryServiceName
+// exists, mirroring the primary app Service's ports but selecting only
+// `track=canary` pods, so the shadow Ingress has something canary-only to
+// route to.
+func (r *nginxTrafficRouter) reconcileCanaryService(ctx context.Context, namespace, appName string) error {
+	primary, err := r.clientset.CoreV1().Services(namespace).Get(ctx, appName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	svc := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      canaryServiceName(appName),
+			Namespace: namespace,
+		},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": appName, "track": "canary"},
+			Ports:    primary.Spec.Ports,
+		},
+	}
+
+	existing, err := r.clientset.CoreV1().Services(namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err := r.clientset.CoreV1().Services(namespace).Create(ctx, svc, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	svc.ResourceVersion = existing.ResourceVersion
+	svc.Spec.ClusterIP = existing.Spec.ClusterIP
+	_, err = r.clientset.CoreV1().Services(namespace).Update(ctx, svc, metav1.UpdateOptions{})
+	return err
+}
+
+// reconcileShadowIngress clones the primary Ingress (named after appName)
+// into one named after canaryIngressName, repoints every rule's Service
+// backend at the canary Service, and carries the nginx-ingress canary
+// annotations that make it split traffic rather than route independently.
+func (r *nginxTrafficRouter) reconcileShadowIngress(ctx context.Context, namespace, appName string, weight int32) error {
+	primary, err := r.clientset.NetworkingV1().Ingresses(namespace).Get(ctx, appName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	shadow := primary.DeepCopy()
+	shadow.ObjectMeta = metav1.ObjectMeta{
+		Name:      canaryIngressName(appName),
+		Namespace: namespace,
+		Annotations: map[string]string{
+			nginxCanaryAnnotation:       "true",
+			nginxCanaryWeightAnnotation: strconv.Itoa(int(weight)),
+		},
+	}
+	for i := range shadow.Spec.Rules {
+		if shadow.Spec.Rules[i].HTTP == nil {
+			continue
+		}
+		for j := range shadow.Spec.Rules[i].HTTP.Paths {
+			backend := shadow.Spec.Rules[i].HTTP.Paths[j].Backend.Service
+			if backend == nil {
+				continue
+			}
+			backend.Name = canaryServiceName(appName)
+		}
+	}
+
+	existing, err := r.clientset.NetworkingV1().Ingresses(namespace).Get(ctx, shadow.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err := r.clientset.NetworkingV1().Ingresses(namespace).Create(ctx, shadow, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	shadow.ResourceVersion = existing.ResourceVersion
+	_, err = r.clientset.NetworkingV1().Ingresses(namespace).Update(ctx, shadow, metav1.UpdateOptions{})
+	return err
+}